@@ -0,0 +1,132 @@
+package picap
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/pkg/errors"
+)
+
+// captureBackend opens one or more capture rings for Main's configured
+// interface/file. Each returned ring is an independent stream of raw
+// packets that can be parsed concurrently; backends that can't fan out
+// across rings (e.g. libpcap) return a single one regardless of
+// m.Fanout.
+type captureBackend interface {
+	Open(m *Main) ([]ring, error)
+}
+
+// ring is a single capture queue: either one libpcap handle or one
+// AF_PACKET socket bound to a fanout group.
+type ring struct {
+	packets chan gopacket.Packet
+}
+
+func newCaptureBackend(name string) (captureBackend, error) {
+	switch name {
+	case "", "pcap":
+		return pcapBackend{}, nil
+	case "afpacket":
+		return afpacketBackend{}, nil
+	default:
+		return nil, errors.Errorf("unknown capture backend: %q", name)
+	}
+}
+
+// shard is one ring's private decode pipeline: its own stream assembler
+// and, optionally, its own IPv4 defragmenter and/or flow table. Keeping
+// this state per-shard means rings never contend with each other, only
+// their results are merged. defrag is independent of mode (fragmented
+// packets need reassembling either way); flows is set only in
+// --mode=flow, where packets are aggregated rather than decoded
+// individually, and the assembler, though still present, is then fed
+// nothing.
+type shard struct {
+	id        int
+	packets   chan gopacket.Packet
+	assembler *streamAssembler
+	defrag    *ipv4Defragmenter
+	flows     *flowTable
+	num       uint64
+}
+
+// run decodes packets from this shard's ring until it closes, sending
+// finished records to out, and sweeps idle state on a ticker. Defrag
+// applies before everything else, in either mode, since a fragmented
+// flow's trailing fragments have no transport layer until reassembled.
+// In packet mode, HTTP (port 80) TCP packets are handed to the
+// assembler, which owns request/response correlation end-to-end and
+// emits its enriched Packet asynchronously once a transaction
+// completes (picked up by the case above); every other packet is
+// reified directly. This is an either/or split by flow, not a race: a
+// packet is never both fed to the assembler and reified, so an HTTP
+// transaction produces exactly one record. In flow mode every packet
+// instead folds into the shard's flow table, which emits a Flow
+// whenever one finishes or times out.
+func (s *shard) run(out chan<- shardResult) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case pkt := <-s.assembler.Packets():
+			s.emit(out, pkt, nil)
+		case <-ticker.C:
+			s.sweep(out)
+		case raw, ok := <-s.packets:
+			if !ok {
+				return
+			}
+			if s.defrag != nil {
+				reassembled, err := s.defrag.Defrag(raw)
+				if err != nil {
+					s.emit(out, nil, errors.Wrap(err, "defragmenting ipv4 packet"))
+					continue
+				}
+				if reassembled == nil {
+					continue
+				}
+				raw = reassembled
+			}
+			if s.flows != nil {
+				if f := s.flows.Update(raw); f != nil {
+					s.emit(out, f, nil)
+				}
+				continue
+			}
+			if isHTTPPacket(raw) {
+				s.assembler.AssemblePacket(raw)
+				continue
+			}
+			pr, err := reifyPacket(raw)
+			s.emit(out, pr, err)
+		}
+	}
+}
+
+// sweep evicts stale state: abandoned reassembled streams, incomplete
+// fragment sets, and (in flow mode) idle or long-lived flows, emitting
+// any flows it closes out.
+func (s *shard) sweep(out chan<- shardResult) {
+	now := time.Now()
+	s.assembler.FlushIdle(2 * time.Minute)
+	if s.defrag != nil {
+		s.defrag.DiscardOlderThan(now.Add(-2 * time.Minute))
+	}
+	if s.flows != nil {
+		for _, f := range s.flows.SweepTimeouts(now) {
+			s.emit(out, f, nil)
+		}
+	}
+}
+
+func (s *shard) emit(out chan<- shardResult, rec interface{}, err error) {
+	atomic.AddUint64(&s.num, 1)
+	out <- shardResult{shardID: s.id, rec: rec, err: err}
+}
+
+type shardResult struct {
+	shardID int
+	rec     interface{}
+	err     error
+}
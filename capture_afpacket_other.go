@@ -0,0 +1,12 @@
+//+build !linux
+
+package picap
+
+import "github.com/pkg/errors"
+
+// afpacketBackend is only available on Linux, where AF_PACKET exists.
+type afpacketBackend struct{}
+
+func (afpacketBackend) Open(m *Main) ([]ring, error) {
+	return nil, errors.New("afpacket capture backend is only supported on linux")
+}
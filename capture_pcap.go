@@ -0,0 +1,35 @@
+package picap
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// pcapBackend captures via libpcap. It has no notion of fanout, so it
+// always returns a single ring regardless of m.Fanout.
+type pcapBackend struct{}
+
+func (pcapBackend) Open(m *Main) ([]ring, error) {
+	if m.Fanout > 1 {
+		log.Printf("picap: --fanout=%d ignored; pcap capture does not support multiple rings", m.Fanout)
+	}
+	var h *pcap.Handle
+	var err error
+	if m.Filename != "" {
+		h, err = pcap.OpenOffline(m.Filename)
+	} else {
+		h, err = pcap.OpenLive(m.Iface, m.Snaplen, m.Promisc, m.Timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open error: %v", err)
+	}
+
+	if err := h.SetBPFFilter(m.Filter); err != nil {
+		return nil, fmt.Errorf("error setting bpf filter: %v", err)
+	}
+	packetSource := gopacket.NewPacketSource(h, h.LinkType())
+	return []ring{{packets: packetSource.Packets()}}, nil
+}
@@ -0,0 +1,324 @@
+package picap
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// AppDecoder extracts application-layer fields from a packet's transport
+// payload (the bytes after the TCP or UDP header), whether or not
+// gopacket's own layer decoding identified it. Decode returns the
+// extracted fields and true if it recognized the payload, or false if it
+// should be skipped in favor of the next decoder in the registry.
+type AppDecoder interface {
+	Decode(payload []byte, transProto string, srcPort, dstPort uint16) (map[string]interface{}, bool)
+}
+
+// appDecoders is the registry of decoders tried, in order, against any
+// application payload that isn't already handled as HTTP. The first
+// decoder to recognize the payload wins.
+var appDecoders = []AppDecoder{
+	dnsDecoder{},
+	tlsDecoder{},
+	sipDecoder{},
+}
+
+// decodeAppLayer runs payload through the decoder registry, returning the
+// name of the proto that recognized it (e.g. "DNS") and its fields, or
+// ("", nil) if nothing matched.
+func decodeAppLayer(payload []byte, transProto string, srcPort, dstPort uint16) (string, map[string]interface{}) {
+	for _, d := range appDecoders {
+		if fields, ok := d.Decode(payload, transProto, srcPort, dstPort); ok {
+			return appDecoderName(d), fields
+		}
+	}
+	return "", nil
+}
+
+func appDecoderName(d AppDecoder) string {
+	switch d.(type) {
+	case dnsDecoder:
+		return "DNS"
+	case tlsDecoder:
+		return "TLS"
+	case sipDecoder:
+		return "SIP"
+	default:
+		return fmt.Sprintf("%T", d)
+	}
+}
+
+// dnsDecoder decodes DNS queries and responses carried over UDP or TCP.
+type dnsDecoder struct{}
+
+func (dnsDecoder) Decode(payload []byte, transProto string, srcPort, dstPort uint16) (map[string]interface{}, bool) {
+	if srcPort != 53 && dstPort != 53 {
+		return nil, false
+	}
+	if transProto == "TCP" {
+		// DNS over TCP prefixes each message with a two-byte length.
+		if len(payload) < 2 {
+			return nil, false
+		}
+		payload = payload[2:]
+	}
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(payload, nil); err != nil {
+		return nil, false
+	}
+	fields := map[string]interface{}{
+		"rcode": dns.ResponseCode.String(),
+	}
+	if len(dns.Questions) > 0 {
+		q := dns.Questions[0]
+		fields["qname"] = string(q.Name)
+		fields["qtype"] = q.Type.String()
+	}
+	answers := make([]string, 0, len(dns.Answers))
+	for _, a := range dns.Answers {
+		switch a.Type {
+		case layers.DNSTypeA:
+			answers = append(answers, a.IP.String())
+		case layers.DNSTypeAAAA:
+			answers = append(answers, a.IP.String())
+		case layers.DNSTypeCNAME:
+			answers = append(answers, string(a.CNAME))
+		default:
+			answers = append(answers, a.String())
+		}
+	}
+	if len(answers) > 0 {
+		fields["answers"] = answers
+	}
+	return fields, true
+}
+
+// tlsDecoder decodes a TLS ClientHello, extracting the SNI hostname and a
+// JA3-style fingerprint (an MD5 hash of the version, cipher list,
+// extension list, and elliptic curve list, following the ja3 spec).
+type tlsDecoder struct{}
+
+func (tlsDecoder) Decode(payload []byte, transProto string, srcPort, dstPort uint16) (map[string]interface{}, bool) {
+	if transProto != "TCP" {
+		return nil, false
+	}
+	hello, ok := parseClientHello(payload)
+	if !ok {
+		return nil, false
+	}
+	fields := map[string]interface{}{
+		"ja3": hello.ja3Hash(),
+	}
+	if hello.sni != "" {
+		fields["sni"] = hello.sni
+	}
+	return fields, true
+}
+
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	sni        string
+}
+
+// ja3Hash computes the JA3 fingerprint: md5("version,ciphers,extensions,curves,curve_point_formats")
+// with each list dash-joined, following the upstream ja3 format (curve
+// point formats are omitted here since picap doesn't track them).
+func (h clientHello) ja3Hash() string {
+	str := fmt.Sprintf("%d,%s,%s,%s,", h.version, joinUint16(h.ciphers), joinUint16(h.extensions), joinUint16(h.curves))
+	sum := md5.Sum([]byte(str))
+	return fmt.Sprintf("%x", sum)
+}
+
+func joinUint16(vals []uint16) string {
+	parts := make([]string, len(vals))
+	for i, v := range vals {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+// parseClientHello does minimal parsing of a TLS record to pull out a
+// ClientHello's handshake fields. It is not a full TLS parser; it bails
+// out (returning ok=false) on anything it doesn't recognize.
+func parseClientHello(b []byte) (clientHello, bool) {
+	var h clientHello
+	r := bytes.NewReader(b)
+
+	var contentType, verMajor, verMinor uint8
+	var recLen uint16
+	if !readUint8(r, &contentType) || contentType != 22 { // handshake
+		return h, false
+	}
+	if !readUint8(r, &verMajor) || !readUint8(r, &verMinor) || !readUint16(r, &recLen) {
+		return h, false
+	}
+
+	var handshakeType uint8
+	var hsLen24 [3]byte
+	if !readUint8(r, &handshakeType) || handshakeType != 1 { // ClientHello
+		return h, false
+	}
+	if _, err := r.Read(hsLen24[:]); err != nil {
+		return h, false
+	}
+
+	var major, minor uint8
+	if !readUint8(r, &major) || !readUint8(r, &minor) {
+		return h, false
+	}
+	h.version = uint16(major)<<8 | uint16(minor)
+
+	var random [32]byte
+	if _, err := r.Read(random[:]); err != nil {
+		return h, false
+	}
+
+	var sessIDLen uint8
+	if !readUint8(r, &sessIDLen) {
+		return h, false
+	}
+	if _, err := r.Seek(int64(sessIDLen), 1); err != nil {
+		return h, false
+	}
+
+	var cipherLen uint16
+	if !readUint16(r, &cipherLen) {
+		return h, false
+	}
+	h.ciphers = make([]uint16, 0, cipherLen/2)
+	for i := uint16(0); i < cipherLen; i += 2 {
+		var c uint16
+		if !readUint16(r, &c) {
+			return h, false
+		}
+		h.ciphers = append(h.ciphers, c)
+	}
+
+	var compLen uint8
+	if !readUint8(r, &compLen) {
+		return h, false
+	}
+	if _, err := r.Seek(int64(compLen), 1); err != nil {
+		return h, false
+	}
+
+	var extTotalLen uint16
+	if !readUint16(r, &extTotalLen) {
+		// No extensions; still a valid (if old) ClientHello.
+		return h, true
+	}
+	end := make([]byte, extTotalLen)
+	n, _ := r.Read(end)
+	extReader := bytes.NewReader(end[:n])
+	for extReader.Len() > 0 {
+		var extType, extLen uint16
+		if !readUint16(extReader, &extType) || !readUint16(extReader, &extLen) {
+			break
+		}
+		body := make([]byte, extLen)
+		if n, err := extReader.Read(body); err != nil || n != len(body) {
+			break
+		}
+		h.extensions = append(h.extensions, extType)
+		switch extType {
+		case 0: // server_name
+			h.sni = parseSNI(body)
+		case 10: // supported_groups / elliptic_curves
+			h.curves = parseCurves(body)
+		}
+	}
+	return h, true
+}
+
+func parseSNI(body []byte) string {
+	r := bytes.NewReader(body)
+	var listLen uint16
+	if !readUint16(r, &listLen) {
+		return ""
+	}
+	var nameType uint8
+	var nameLen uint16
+	if !readUint8(r, &nameType) || !readUint16(r, &nameLen) {
+		return ""
+	}
+	name := make([]byte, nameLen)
+	if n, err := r.Read(name); err != nil || n != len(name) {
+		return ""
+	}
+	return string(name)
+}
+
+func parseCurves(body []byte) []uint16 {
+	r := bytes.NewReader(body)
+	var listLen uint16
+	if !readUint16(r, &listLen) {
+		return nil
+	}
+	curves := make([]uint16, 0, listLen/2)
+	for i := uint16(0); i < listLen; i += 2 {
+		var c uint16
+		if !readUint16(r, &c) {
+			break
+		}
+		curves = append(curves, c)
+	}
+	return curves
+}
+
+func readUint8(r *bytes.Reader, v *uint8) bool {
+	b, err := r.ReadByte()
+	if err != nil {
+		return false
+	}
+	*v = b
+	return true
+}
+
+func readUint16(r *bytes.Reader, v *uint16) bool {
+	var buf [2]byte
+	if n, err := r.Read(buf[:]); err != nil || n != len(buf) {
+		return false
+	}
+	*v = uint16(buf[0])<<8 | uint16(buf[1])
+	return true
+}
+
+// sipDecoder decodes SIP requests carried over UDP, pulling the method
+// and a handful of headers directly out of the text payload.
+type sipDecoder struct{}
+
+func (sipDecoder) Decode(payload []byte, transProto string, srcPort, dstPort uint16) (map[string]interface{}, bool) {
+	if transProto != "UDP" {
+		return nil, false
+	}
+	lines := strings.Split(string(payload), "\r\n")
+	if len(lines) == 0 {
+		return nil, false
+	}
+	startLine := strings.Fields(lines[0])
+	if len(startLine) < 3 || !strings.HasSuffix(startLine[2], "SIP/2.0") {
+		return nil, false
+	}
+	fields := map[string]interface{}{
+		"method": startLine[0],
+	}
+	for _, line := range lines[1:] {
+		switch {
+		case strings.HasPrefix(line, "From:"), strings.HasPrefix(line, "f:"):
+			fields["from"] = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		case strings.HasPrefix(line, "To:"), strings.HasPrefix(line, "t:"):
+			fields["to"] = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		case strings.HasPrefix(line, "Call-ID:"), strings.HasPrefix(line, "i:"):
+			fields["call_id"] = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		}
+	}
+	return fields, true
+}
@@ -0,0 +1,151 @@
+package picap
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestJoinUint16(t *testing.T) {
+	got := joinUint16([]uint16{4865, 4866, 4867})
+	want := "4865-4866-4867"
+	if got != want {
+		t.Fatalf("joinUint16 = %q, want %q", got, want)
+	}
+	if joinUint16(nil) != "" {
+		t.Fatalf("joinUint16(nil) = %q, want empty string", joinUint16(nil))
+	}
+}
+
+func TestJa3HashDeterministic(t *testing.T) {
+	h := clientHello{
+		version:    0x0303,
+		ciphers:    []uint16{0x1301, 0x1302},
+		extensions: []uint16{0, 10, 11},
+		curves:     []uint16{29, 23, 24},
+	}
+	got1 := h.ja3Hash()
+	got2 := h.ja3Hash()
+	if got1 != got2 {
+		t.Fatalf("ja3Hash is not deterministic: %q != %q", got1, got2)
+	}
+	if len(got1) != 32 {
+		t.Fatalf("ja3Hash length = %d, want 32 (md5 hex)", len(got1))
+	}
+
+	other := h
+	other.ciphers = []uint16{0x1303}
+	if other.ja3Hash() == got1 {
+		t.Fatalf("expected different cipher lists to produce different ja3 hashes")
+	}
+}
+
+// buildClientHello assembles a minimal TLS record containing a
+// ClientHello handshake with a single server_name extension, mirroring
+// the wire format parseClientHello expects.
+func buildClientHello(t *testing.T, sni string) []byte {
+	t.Helper()
+
+	serverName := []byte(sni)
+	// server_name extension data: a ServerNameList of one ServerName entry.
+	sniExtData := append(uint16Bytes(len(serverName)+3), 0) // list length, name type (host_name)
+	sniExtData = append(sniExtData, uint16Bytes(len(serverName))...)
+	sniExtData = append(sniExtData, serverName...)
+
+	// One extension entry: type(2) + length(2) + data.
+	sniExtEntry := append(uint16Bytes(0), uint16Bytes(len(sniExtData))...)
+	sniExtEntry = append(sniExtEntry, sniExtData...)
+
+	var body []byte
+	body = append(body, 3, 3)                // client version
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session id length
+	body = append(body, 0, 2, 0x13, 0x01)     // cipher suites length + one cipher
+	body = append(body, 1, 0)                 // compression methods length + null method
+	body = append(body, uint16Bytes(len(sniExtEntry))...)
+	body = append(body, sniExtEntry...)
+
+	handshake := append([]byte{1}, uint24(len(body))...) // handshake type 1 = ClientHello
+	handshake = append(handshake, body...)
+
+	record := append([]byte{22, 3, 1}, uint16Bytes(len(handshake))...) // content type 22 = handshake
+	record = append(record, handshake...)
+	return record
+}
+
+func uint24(n int) []byte {
+	return []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func uint16Bytes(n int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	return b
+}
+
+func TestParseClientHelloExtractsSNI(t *testing.T) {
+	record := buildClientHello(t, "example.com")
+
+	hello, ok := parseClientHello(record)
+	if !ok {
+		t.Fatalf("parseClientHello failed to recognize a well-formed ClientHello")
+	}
+	if hello.sni != "example.com" {
+		t.Fatalf("sni = %q, want %q", hello.sni, "example.com")
+	}
+}
+
+func TestParseClientHelloRejectsNonHandshake(t *testing.T) {
+	if _, ok := parseClientHello([]byte{23, 3, 1, 0, 0}); ok {
+		t.Fatalf("parseClientHello should reject non-handshake content types")
+	}
+}
+
+// TestParseClientHelloRejectsTruncatedExtension covers the short-read fix:
+// a ClientHello truncated mid-SNI used to let bytes.Reader's partial Read
+// through unchecked, silently yielding a corrupted (zero-padded) SNI
+// instead of leaving it unset.
+func TestParseClientHelloRejectsTruncatedExtension(t *testing.T) {
+	record := buildClientHello(t, "example.com")
+	truncated := record[:len(record)-5]
+
+	hello, _ := parseClientHello(truncated)
+	if hello.sni == "example.com" {
+		t.Fatalf("expected a truncated SNI extension to be rejected, not parsed as the full hostname")
+	}
+}
+
+func TestSIPDecoderParsesHeaders(t *testing.T) {
+	payload := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"From: <sip:alice@example.com>\r\n" +
+		"To: <sip:bob@example.com>\r\n" +
+		"Call-ID: abc123@example.com\r\n\r\n"
+
+	fields, ok := sipDecoder{}.Decode([]byte(payload), "UDP", 5060, 5060)
+	if !ok {
+		t.Fatalf("sipDecoder failed to recognize a well-formed INVITE")
+	}
+	if fields["method"] != "INVITE" {
+		t.Fatalf("method = %v, want INVITE", fields["method"])
+	}
+	if fields["from"] != "<sip:alice@example.com>" {
+		t.Fatalf("from = %v, want <sip:alice@example.com>", fields["from"])
+	}
+	if fields["to"] != "<sip:bob@example.com>" {
+		t.Fatalf("to = %v, want <sip:bob@example.com>", fields["to"])
+	}
+	if fields["call_id"] != "abc123@example.com" {
+		t.Fatalf("call_id = %v, want abc123@example.com", fields["call_id"])
+	}
+}
+
+func TestSIPDecoderRejectsNonUDP(t *testing.T) {
+	if _, ok := (sipDecoder{}).Decode([]byte("INVITE sip:bob@example.com SIP/2.0\r\n"), "TCP", 5060, 5060); ok {
+		t.Fatalf("sipDecoder should only claim UDP payloads")
+	}
+}
+
+func TestSIPDecoderRejectsNonSIP(t *testing.T) {
+	if _, ok := (sipDecoder{}).Decode([]byte("not a sip message"), "UDP", 5060, 5060); ok {
+		t.Fatalf("sipDecoder should reject payloads without a SIP/2.0 start line")
+	}
+}
@@ -0,0 +1,75 @@
+package picap
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// ipv4Defragmenter wraps ip4defrag.IPv4Defragmenter so NewNetSource can
+// reassemble fragmented IPv4 datagrams before handing them to reifyPacket.
+// Non-IPv4 and unfragmented packets pass through untouched; intermediate
+// fragments are dropped until their datagram is complete.
+type ipv4Defragmenter struct {
+	defrag *ip4defrag.IPv4Defragmenter
+}
+
+func newIPv4Defragmenter() *ipv4Defragmenter {
+	return &ipv4Defragmenter{defrag: ip4defrag.NewIPv4Defragmenter()}
+}
+
+// Defrag returns the packet to use going forward, or nil if pkt was an
+// incomplete fragment that has been buffered awaiting the rest of the
+// datagram. On reassembly it rebuilds a full gopacket.Packet from the
+// defragmented IPv4 payload so later layers (transport, application)
+// decode normally.
+func (d *ipv4Defragmenter) Defrag(pkt gopacket.Packet) (gopacket.Packet, error) {
+	ip4Layer := pkt.Layer(layers.LayerTypeIPv4)
+	if ip4Layer == nil {
+		return pkt, nil
+	}
+	ip4 := ip4Layer.(*layers.IPv4)
+
+	out, err := d.defrag.DefragIPv4(ip4)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		// An intermediate fragment; wait for the rest of the datagram.
+		return nil, nil
+	}
+	if out == ip4 {
+		// Unfragmented packet; nothing to rebuild.
+		return pkt, nil
+	}
+
+	payload, err := serializeIPv4(out)
+	if err != nil {
+		return nil, err
+	}
+	rebuilt := gopacket.NewPacket(payload, layers.LayerTypeIPv4, gopacket.Default)
+	m := pkt.Metadata()
+	rebuilt.Metadata().CaptureInfo = m.CaptureInfo
+	rebuilt.Metadata().Length = len(payload)
+	return rebuilt, nil
+}
+
+// DiscardOlderThan forwards to the underlying defragmenter's sweep so
+// abandoned fragment sets don't grow the defrag table unbounded.
+func (d *ipv4Defragmenter) DiscardOlderThan(t time.Time) int {
+	return d.defrag.DiscardOlderThan(t)
+}
+
+// serializeIPv4 re-encodes a reassembled IPv4 layer (header + full
+// payload) into bytes suitable for gopacket.NewPacket.
+func serializeIPv4(ip4 *layers.IPv4) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ip4, gopacket.Payload(ip4.Payload))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
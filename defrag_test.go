@@ -0,0 +1,42 @@
+package picap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestIPv4DefragmenterPassesThroughNonIPv4(t *testing.T) {
+	d := newIPv4Defragmenter()
+
+	// 14 zero bytes decode as an (invalid) Ethernet frame with no IPv4
+	// layer at all; Defrag should hand it back unchanged rather than
+	// erroring or buffering it as a fragment.
+	pkt := gopacket.NewPacket(make([]byte, 14), layers.LayerTypeEthernet, gopacket.Default)
+
+	out, err := d.Defrag(pkt)
+	if err != nil {
+		t.Fatalf("Defrag returned an error for a non-IPv4 packet: %v", err)
+	}
+	if out == nil {
+		t.Fatalf("Defrag dropped a non-IPv4 packet instead of passing it through")
+	}
+}
+
+func TestIPv4DefragmenterPassesThroughUnfragmented(t *testing.T) {
+	d := newIPv4Defragmenter()
+	pkt := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, nil, time.Now())
+
+	out, err := d.Defrag(pkt)
+	if err != nil {
+		t.Fatalf("Defrag returned an error for an unfragmented packet: %v", err)
+	}
+	if out == nil {
+		t.Fatalf("Defrag dropped an unfragmented packet instead of passing it through")
+	}
+	if out.NetworkLayer() == nil || out.NetworkLayer().LayerType() != layers.LayerTypeIPv4 {
+		t.Fatalf("expected the passed-through packet to still decode as IPv4")
+	}
+}
@@ -0,0 +1,108 @@
+package picap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestNewFiveTupleCanonicalizesDirection(t *testing.T) {
+	pktAB := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, nil, time.Time{})
+	pktBA := buildTCPPacket(t, "10.0.0.2", "10.0.0.1", 80, 54321, nil, time.Time{})
+
+	keyAB := newFiveTuple(pktAB.NetworkLayer().NetworkFlow(), pktAB.TransportLayer().TransportFlow(), "TCP")
+	keyBA := newFiveTuple(pktBA.NetworkLayer().NetworkFlow(), pktBA.TransportLayer().TransportFlow(), "TCP")
+
+	if keyAB != keyBA {
+		t.Fatalf("expected forward and reverse direction to produce the same five-tuple, got %+v and %+v", keyAB, keyBA)
+	}
+}
+
+func TestNewFiveTupleDistinguishesProto(t *testing.T) {
+	pkt := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, nil, time.Time{})
+	tcpKey := newFiveTuple(pkt.NetworkLayer().NetworkFlow(), pkt.TransportLayer().TransportFlow(), "TCP")
+	udpKey := newFiveTuple(pkt.NetworkLayer().NetworkFlow(), pkt.TransportLayer().TransportFlow(), "UDP")
+
+	if tcpKey == udpKey {
+		t.Fatalf("expected different transport protocols to produce distinct five-tuples")
+	}
+}
+
+func TestFlowTableUpdateAccumulatesAndEmitsOnFIN(t *testing.T) {
+	ft := newFlowTable(time.Minute, time.Hour)
+	base := time.Unix(1000, 0)
+
+	syn := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, func(tcp *layers.TCP) { tcp.SYN = true }, base)
+	if f := ft.Update(syn); f != nil {
+		t.Fatalf("expected no flow to be emitted on SYN, got %+v", f)
+	}
+
+	ack := buildTCPPacket(t, "10.0.0.2", "10.0.0.1", 80, 54321, func(tcp *layers.TCP) { tcp.ACK = true }, base.Add(time.Second))
+	if f := ft.Update(ack); f != nil {
+		t.Fatalf("expected no flow to be emitted on ACK, got %+v", f)
+	}
+
+	fin := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, func(tcp *layers.TCP) { tcp.FIN = true }, base.Add(2*time.Second))
+	f := ft.Update(fin)
+	if f == nil {
+		t.Fatalf("expected a flow to be emitted on FIN")
+	}
+	if f.Packets != 3 {
+		t.Fatalf("Packets = %d, want 3", f.Packets)
+	}
+	if !f.TCP.SYN || !f.TCP.ACK || !f.TCP.FIN {
+		t.Fatalf("expected TCP flags to be OR'd across the flow's packets, got %+v", f.TCP)
+	}
+	if !f.FirstSeen.Equal(base) {
+		t.Fatalf("FirstSeen = %v, want %v", f.FirstSeen, base)
+	}
+	if !f.LastSeen.Equal(base.Add(2 * time.Second)) {
+		t.Fatalf("LastSeen = %v, want %v", f.LastSeen, base.Add(2*time.Second))
+	}
+
+	if len(ft.entries) != 0 {
+		t.Fatalf("expected the flow entry to be removed after FIN, %d entries remain", len(ft.entries))
+	}
+}
+
+func TestFlowTableSweepTimeoutsEvictsIdleAndActive(t *testing.T) {
+	ft := newFlowTable(10*time.Second, time.Minute)
+	base := time.Unix(2000, 0)
+
+	idleFlow := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 1111, 80, nil, base)
+	ft.Update(idleFlow)
+	ft.Update(buildTCPPacket(t, "10.0.0.3", "10.0.0.4", 2222, 80, nil, base))
+
+	// Neither flow should be swept immediately.
+	if done := ft.SweepTimeouts(base.Add(time.Second)); len(done) != 0 {
+		t.Fatalf("expected no flows swept yet, got %d", len(done))
+	}
+
+	// Keep the active flow's last-seen fresh right up to each check, so
+	// it only ever times out via FirstSeen (activeTimeout), never via
+	// LastSeen (idleTimeout), while idleFlow is never touched again and
+	// goes stale past idleTimeout.
+	check := base.Add(20 * time.Second)
+	ft.Update(buildTCPPacket(t, "10.0.0.3", "10.0.0.4", 2222, 80, nil, check))
+	done := ft.SweepTimeouts(check)
+	if len(done) != 1 {
+		t.Fatalf("expected exactly one flow swept for idle timeout, got %d", len(done))
+	}
+	if done[0].NetSrc != idleFlow.NetworkLayer().NetworkFlow().Src().String() {
+		t.Fatalf("swept the wrong flow: %+v", done[0])
+	}
+
+	// The remaining (active) flow eventually gets swept for exceeding its
+	// active timeout even though it's never gone idle.
+	check = base.Add(2 * time.Minute)
+	ft.Update(buildTCPPacket(t, "10.0.0.3", "10.0.0.4", 2222, 80, nil, check))
+	done = ft.SweepTimeouts(check)
+	if len(done) != 1 {
+		t.Fatalf("expected the remaining flow to be swept for its active timeout, got %d", len(done))
+	}
+
+	if len(ft.entries) != 0 {
+		t.Fatalf("expected no flows left in the table, %d remain", len(ft.entries))
+	}
+}
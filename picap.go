@@ -1,18 +1,13 @@
 package picap
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/pilosa/pdk"
 	"github.com/pkg/errors"
 )
@@ -32,6 +27,15 @@ type Main struct {
 	MappingDir  string        `help:"Directory to store mapping data. Empty string uses a temp dir."`
 	Debug       bool          `help:"Turn on debug logging."`
 	Translator  string        `help:"How to store mappings. In memory(mem) or LevelDB(level)."`
+	Defrag      bool          `help:"Reassemble fragmented IPv4 packets before decoding."`
+	Capture     string        `help:"Capture backend to use: pcap or afpacket."`
+	Fanout      int           `help:"Number of capture rings to fan out across (afpacket only)."`
+	BlockSize   int           `help:"AF_PACKET ring block size in bytes (afpacket only)."`
+	NumBlocks   int           `help:"AF_PACKET ring block count (afpacket only)."`
+	RingTimeout time.Duration `help:"AF_PACKET ring poll timeout (afpacket only)."`
+	Mode        string        `help:"Record mode: packet (one record per packet) or flow (aggregated per 5-tuple)."`
+	FlowIdle    time.Duration `help:"Emit a flow once it has been idle this long (mode=flow only)."`
+	FlowActive  time.Duration `help:"Emit a flow once it has been open this long, even if still active (mode=flow only)."`
 }
 
 // NewMain constructs a Main with default values.
@@ -46,6 +50,14 @@ func NewMain() *Main {
 		BindAddr:    "localhost:11000",
 		BufSize:     100000,
 		Translator:  "mem",
+		Capture:     "pcap",
+		Fanout:      1,
+		BlockSize:   1 << 20,
+		NumBlocks:   128,
+		RingTimeout: time.Millisecond,
+		Mode:        "packet",
+		FlowIdle:    15 * time.Second,
+		FlowActive:  30 * time.Minute,
 	}
 }
 
@@ -92,45 +104,82 @@ func (m *Main) Run() error {
 	return ingester.Run()
 }
 
+// NewNetSource opens the configured capture backend (pcap, or afpacket
+// fanned out across m.Fanout rings) and gives each ring its own shard of
+// decode state. Each shard parses its ring in its own goroutine, and
+// their results are merged onto a single channel that every Record call
+// drains. m.Concurrency does not affect how rings are parsed.
 func (m *Main) NewNetSource() (*NetSource, error) {
-	var h *pcap.Handle
-	var err error
-	if m.Filename != "" {
-		h, err = pcap.OpenOffline(m.Filename)
-	} else {
-		h, err = pcap.OpenLive(m.Iface, m.Snaplen, m.Promisc, m.Timeout)
-	}
+	backend, err := newCaptureBackend(m.Capture)
 	if err != nil {
-		return nil, fmt.Errorf("open error: %v", err)
+		return nil, err
 	}
-
-	err = h.SetBPFFilter(m.Filter)
+	rings, err := backend.Open(m)
 	if err != nil {
-		return nil, fmt.Errorf("error setting bpf filter: %v", err)
+		return nil, errors.Wrap(err, "opening capture backend")
 	}
-	packetSource := gopacket.NewPacketSource(h, h.LinkType())
-	packets := packetSource.Packets()
-	num := uint64(0)
-	np := &NetSource{
-		num:     &num,
-		packets: packets,
+
+	out := make(chan shardResult, 1000)
+	shards := make([]*shard, len(rings))
+	for i, r := range rings {
+		s := &shard{
+			id:        i,
+			packets:   r.packets,
+			assembler: newStreamAssembler(),
+		}
+		switch m.Mode {
+		case "", "packet":
+		case "flow":
+			s.flows = newFlowTable(m.FlowIdle, m.FlowActive)
+		default:
+			return nil, errors.Errorf("unknown mode: %q", m.Mode)
+		}
+		// Defrag applies in either mode: a fragmented flow's trailing
+		// fragments carry no transport layer until reassembled, so
+		// skipping this in --mode=flow would silently drop them from
+		// the flow's packet/byte counts.
+		if m.Defrag {
+			s.defrag = newIPv4Defragmenter()
+		}
+		shards[i] = s
+		go s.run(out)
 	}
-	return np, nil
+
+	return &NetSource{
+		shards: shards,
+		out:    out,
+	}, nil
 }
 
 type NetSource struct {
-	num     *uint64
-	debug   bool
-	packets chan gopacket.Packet
+	debug  bool
+	shards []*shard
+	out    chan shardResult
 }
 
+// Record returns the next available record from any shard. In packet
+// mode that's either a reassembled HTTP request/response pair, once
+// one completes, or a raw packet decoded by reifyPacket for anything
+// that isn't HTTP traffic the assembler owns; in flow mode it's a Flow
+// whenever one finishes or times out.
 func (n *NetSource) Record() (interface{}, error) {
-	atomic.AddUint64(n.num, 1)
-	num := atomic.LoadUint64(n.num)
-	if n.debug && num%1000 == 20 {
-		log.Println("Record has reported", num, "packets")
+	res := <-n.out
+	if n.debug {
+		if total := n.total(); total%1000 == 20 {
+			log.Println("Record has reported", total, "packets across", len(n.shards), "shards")
+		}
+	}
+	return res.rec, res.err
+}
+
+// total sums each shard's independent atomic packet counter into the
+// single rolling count Main.Debug logs.
+func (n *NetSource) total() uint64 {
+	var total uint64
+	for _, s := range n.shards {
+		total += atomic.LoadUint64(&s.num)
 	}
-	return reifyPacket(<-n.packets)
+	return total
 }
 
 type Packet struct {
@@ -158,10 +207,19 @@ type Packet struct {
 	AppProto string
 
 	HTTP struct {
-		Hostname  string
-		UserAgent string
-		Method    string
+		Hostname      string
+		UserAgent     string
+		Method        string
+		StatusCode    int
+		ContentLength int64
+		ContentType   string
+		LatencyMS     float64
 	}
+
+	// Fields holds attributes extracted by an AppDecoder (DNS, TLS, SIP,
+	// ...) keyed by decoder-chosen names, so new protocols can be indexed
+	// without adding a dedicated struct field for each one.
+	Fields map[string]interface{}
 }
 
 func reifyPacket(pkt gopacket.Packet) (*Packet, error) {
@@ -193,33 +251,33 @@ func reifyPacket(pkt gopacket.Packet) (*Packet, error) {
 	pr.TransSrc = transSrc.String()
 	pr.TransDst = transDst.String()
 
-	if tcpLayer, ok := transLayer.(*layers.TCP); ok {
-		pr.TCP.FIN = tcpLayer.FIN
-		pr.TCP.SYN = tcpLayer.SYN
-		pr.TCP.RST = tcpLayer.RST
-		pr.TCP.PSH = tcpLayer.PSH
-		pr.TCP.ACK = tcpLayer.ACK
-		pr.TCP.URG = tcpLayer.URG
-		pr.TCP.ECE = tcpLayer.ECE
-		pr.TCP.CWR = tcpLayer.CWR
-		pr.TCP.NS = tcpLayer.NS
+	var srcPort, dstPort uint16
+	switch t := transLayer.(type) {
+	case *layers.TCP:
+		pr.TCP.FIN = t.FIN
+		pr.TCP.SYN = t.SYN
+		pr.TCP.RST = t.RST
+		pr.TCP.PSH = t.PSH
+		pr.TCP.ACK = t.ACK
+		pr.TCP.URG = t.URG
+		pr.TCP.ECE = t.ECE
+		pr.TCP.CWR = t.CWR
+		pr.TCP.NS = t.NS
+		srcPort, dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	case *layers.UDP:
+		srcPort, dstPort = uint16(t.SrcPort), uint16(t.DstPort)
 	}
+
+	// HTTP is decoded stream-wide by the assembler (see stream.go), which
+	// owns request/response correlation; reifyPacket only ever sees raw
+	// per-packet payloads, so it defers to the decoder registry for
+	// everything else instead of re-guessing HTTP itself.
 	appLayer := pkt.ApplicationLayer()
 	if appLayer != nil {
-		appProto := appLayer.LayerType()
-		pr.AppProto = appProto.String()
-		appBytes := appLayer.Payload()
-		buf := bytes.NewBuffer(appBytes)
-		req, err := http.ReadRequest(bufio.NewReader(buf))
-		if err == nil {
-			pr.HTTP.UserAgent = req.UserAgent()
-			pr.HTTP.Method = req.Method
-			pr.HTTP.Hostname = req.Host
-		} else {
-			// try HTTP response?
-			// resp, err := http.ReadResponse(bufio.NewReader(buf))
-			// 	if err == nil {
-			// 	}
+		pr.AppProto = appLayer.LayerType().String()
+		if proto, fields := decodeAppLayer(transLayer.LayerPayload(), pr.TransProto, srcPort, dstPort); proto != "" {
+			pr.AppProto = proto
+			pr.Fields = fields
 		}
 	}
 	return pr, nil
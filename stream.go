@@ -0,0 +1,283 @@
+package picap
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+// flowKey identifies a single TCP flow by its 4-tuple, canonicalized so
+// that both directions of a connection map to the same key.
+type flowKey struct {
+	net   gopacket.Flow
+	trans gopacket.Flow
+}
+
+func newFlowKey(net, trans gopacket.Flow) flowKey {
+	if net.Src().LessThan(net.Dst()) || (net.Src() == net.Dst() && trans.Src().LessThan(trans.Dst())) {
+		net = net.Reverse()
+		trans = trans.Reverse()
+	}
+	return flowKey{net: net, trans: trans}
+}
+
+// pendingRequest tracks an in-flight HTTP request awaiting its response so
+// that latency and response fields can be attached to a single Packet.
+// start and seenAt serve different clocks on purpose: start is wall-clock
+// time, used only as the staleness clock for sweepPending (a request
+// whose response never arrives is evicted rather than held onto
+// forever); seenAt is the request's on-wire capture timestamp, used to
+// compute latency against the response's own capture timestamp so
+// latency reflects the capture, not however fast this process happens
+// to parse it (which would be meaningless for offline pcap replay).
+type pendingRequest struct {
+	method   string
+	hostname string
+	ua       string
+	start    time.Time
+	seenAt   time.Time
+}
+
+// httpPort is the well-known TCP port shard.run uses to decide whether a
+// packet belongs to an HTTP stream that the assembler should own
+// end-to-end, mirroring how decoders.go recognizes DNS by port 53.
+const httpPort = 80
+
+// isHTTPPacket reports whether pkt is a TCP segment to or from httpPort,
+// i.e. one that belongs to a stream the assembler reassembles and emits
+// on its own; anything else is reified directly instead.
+func isHTTPPacket(pkt gopacket.Packet) bool {
+	tcpLayer := pkt.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return false
+	}
+	tcp := tcpLayer.(*layers.TCP)
+	return tcp.SrcPort == layers.TCPPort(httpPort) || tcp.DstPort == layers.TCPPort(httpPort)
+}
+
+// httpStreamFactory builds an httpStream per TCP flow and pairs requests
+// with responses across the two halves of a connection.
+type httpStreamFactory struct {
+	out chan *Packet
+
+	mu      sync.Mutex
+	pending map[flowKey]*pendingRequest
+}
+
+func newHTTPStreamFactory(out chan *Packet) *httpStreamFactory {
+	return &httpStreamFactory{
+		out:     out,
+		pending: map[flowKey]*pendingRequest{},
+	}
+}
+
+// New implements tcpassembly.StreamFactory.
+func (f *httpStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	s := &httpStream{
+		factory:   f,
+		net:       net,
+		transport: transport,
+		r:         tcpreader.NewReaderStream(),
+	}
+	go s.run()
+	return s
+}
+
+// httpStream reads one direction of a TCP connection and decodes each
+// message on it as an HTTP response if it begins with "HTTP", or as an
+// HTTP request otherwise. It sits between the assembler and the
+// underlying tcpreader.ReaderStream so it can record each reassembled
+// chunk's capture timestamp alongside the bytes, letting readRequest
+// and readResponse compute latency from on-wire time instead of
+// wall-clock parse time (which would be meaningless for offline pcap
+// replay).
+type httpStream struct {
+	factory   *httpStreamFactory
+	net       gopacket.Flow
+	transport gopacket.Flow
+	r         tcpreader.ReaderStream
+
+	mu   sync.Mutex
+	seen time.Time
+}
+
+// Reassembled implements tcpassembly.Stream, forwarding each chunk to
+// the underlying ReaderStream while tracking the capture timestamp of
+// the most recent one.
+func (s *httpStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	if n := len(reassembly); n > 0 {
+		s.mu.Lock()
+		s.seen = reassembly[n-1].Seen
+		s.mu.Unlock()
+	}
+	s.r.Reassembled(reassembly)
+}
+
+// ReassemblyComplete implements tcpassembly.Stream.
+func (s *httpStream) ReassemblyComplete() {
+	s.r.ReassemblyComplete()
+}
+
+// timestamp returns the capture timestamp of the most recent reassembled
+// chunk consumed so far, i.e. roughly when the bytes just read arrived
+// on the wire.
+func (s *httpStream) timestamp() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seen
+}
+
+func (s *httpStream) run() {
+	buf := bufio.NewReader(&s.r)
+	key := newFlowKey(s.net, s.transport)
+	for {
+		peeked, err := buf.Peek(4)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("picap: stream read error: %v", err)
+			}
+			return
+		}
+		if looksLikeHTTPResponse(peeked) {
+			s.readResponse(buf, key)
+		} else {
+			s.readRequest(buf, key)
+		}
+	}
+}
+
+func looksLikeHTTPResponse(b []byte) bool {
+	return len(b) >= 4 && string(b[:4]) == "HTTP"
+}
+
+func (s *httpStream) readRequest(buf *bufio.Reader, key flowKey) {
+	req, err := http.ReadRequest(buf)
+	if err != nil {
+		if err != io.EOF {
+			tcpreader.DiscardBytesToFirstError(buf)
+		}
+		return
+	}
+	defer req.Body.Close()
+	tcpreader.DiscardBytesToEOF(req.Body)
+
+	s.factory.mu.Lock()
+	s.factory.pending[key] = &pendingRequest{
+		method:   req.Method,
+		hostname: req.Host,
+		ua:       req.UserAgent(),
+		start:    time.Now(),
+		seenAt:   s.timestamp(),
+	}
+	s.factory.mu.Unlock()
+}
+
+func (s *httpStream) readResponse(buf *bufio.Reader, key flowKey) {
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil {
+		if err != io.EOF {
+			tcpreader.DiscardBytesToFirstError(buf)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	tcpreader.DiscardBytesToEOF(resp.Body)
+
+	netSrc, netDst := s.net.Endpoints()
+	transSrc, transDst := s.transport.Endpoints()
+
+	pr := &Packet{
+		NetProto:   s.net.EndpointType().String(),
+		NetSrc:     netSrc.String(),
+		NetDst:     netDst.String(),
+		TransProto: layers.LayerTypeTCP.String(),
+		TransSrc:   transSrc.String(),
+		TransDst:   transDst.String(),
+		AppProto:   "HTTP",
+	}
+	pr.HTTP.StatusCode = resp.StatusCode
+	pr.HTTP.ContentLength = resp.ContentLength
+	pr.HTTP.ContentType = resp.Header.Get("Content-Type")
+
+	s.factory.mu.Lock()
+	if req, ok := s.factory.pending[key]; ok {
+		pr.HTTP.Method = req.method
+		pr.HTTP.Hostname = req.hostname
+		pr.HTTP.UserAgent = req.ua
+		pr.HTTP.LatencyMS = float64(s.timestamp().Sub(req.seenAt)) / float64(time.Millisecond)
+		delete(s.factory.pending, key)
+	}
+	s.factory.mu.Unlock()
+
+	s.factory.out <- pr
+}
+
+// sweepPending evicts requests that have been waiting longer than
+// olderThan for a response that's never going to arrive, so a capture
+// with a steady trickle of unanswered requests doesn't grow this map
+// forever.
+func (f *httpStreamFactory) sweepPending(olderThan time.Duration) {
+	cutoff := time.Now().Add(-olderThan)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, req := range f.pending {
+		if req.start.Before(cutoff) {
+			delete(f.pending, key)
+		}
+	}
+}
+
+// streamAssembler drives a tcpassembly.Assembler from the packet capture
+// loop, periodically flushing stale connections.
+type streamAssembler struct {
+	assembler *tcpassembly.Assembler
+	factory   *httpStreamFactory
+	out       chan *Packet
+}
+
+// newStreamAssembler builds an assembler that emits enriched HTTP Packet
+// records on the returned channel as streams are reassembled.
+func newStreamAssembler() *streamAssembler {
+	out := make(chan *Packet, 1000)
+	factory := newHTTPStreamFactory(out)
+	pool := tcpassembly.NewStreamPool(factory)
+	return &streamAssembler{
+		assembler: tcpassembly.NewAssembler(pool),
+		factory:   factory,
+		out:       out,
+	}
+}
+
+// AssemblePacket feeds a single decoded packet's TCP layer into the
+// assembler, if it has one.
+func (a *streamAssembler) AssemblePacket(pkt gopacket.Packet) {
+	netLayer := pkt.NetworkLayer()
+	tcpLayer := pkt.Layer(layers.LayerTypeTCP)
+	if netLayer == nil || tcpLayer == nil {
+		return
+	}
+	tcp := tcpLayer.(*layers.TCP)
+	a.assembler.AssembleWithTimestamp(netLayer.NetworkFlow(), tcp, pkt.Metadata().Timestamp)
+}
+
+// FlushIdle runs on a ticker to evict connection state for streams that
+// have gone quiet and requests that have been waiting longer than
+// olderThan for a response, so the assembler's memory stays bounded.
+func (a *streamAssembler) FlushIdle(olderThan time.Duration) {
+	a.assembler.FlushOlderThan(time.Now().Add(-olderThan))
+	a.factory.sweepPending(olderThan)
+}
+
+// Packets returns the channel of enriched HTTP Packet records produced as
+// streams are reassembled and paired.
+func (a *streamAssembler) Packets() <-chan *Packet {
+	return a.out
+}
@@ -0,0 +1,173 @@
+package picap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildTCPPacket serializes a minimal IPv4/TCP packet for use in tests
+// that need a real gopacket.Packet without a capture device.
+func buildTCPPacket(t *testing.T, srcIP, dstIP string, srcPort, dstPort uint16, flags func(*layers.TCP), ts time.Time) gopacket.Packet {
+	t.Helper()
+
+	ip4 := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Id:       1,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Window:  1024,
+	}
+	if flags != nil {
+		flags(tcp)
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip4); err != nil {
+		t.Fatalf("setting network layer for checksum: %v", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip4, tcp); err != nil {
+		t.Fatalf("serializing packet: %v", err)
+	}
+
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	pkt.Metadata().Timestamp = ts
+	pkt.Metadata().Length = len(buf.Bytes())
+	return pkt
+}
+
+func TestNewFlowKeyCanonicalizesDirection(t *testing.T) {
+	pktAB := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, nil, time.Time{})
+	pktBA := buildTCPPacket(t, "10.0.0.2", "10.0.0.1", 80, 54321, nil, time.Time{})
+
+	keyAB := newFlowKey(pktAB.NetworkLayer().NetworkFlow(), pktAB.TransportLayer().TransportFlow())
+	keyBA := newFlowKey(pktBA.NetworkLayer().NetworkFlow(), pktBA.TransportLayer().TransportFlow())
+
+	if keyAB != keyBA {
+		t.Fatalf("expected forward and reverse direction to produce the same flow key, got %+v and %+v", keyAB, keyBA)
+	}
+}
+
+func TestNewFlowKeyDistinguishesFlows(t *testing.T) {
+	pkt1 := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, nil, time.Time{})
+	pkt2 := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54322, 80, nil, time.Time{})
+
+	key1 := newFlowKey(pkt1.NetworkLayer().NetworkFlow(), pkt1.TransportLayer().TransportFlow())
+	key2 := newFlowKey(pkt2.NetworkLayer().NetworkFlow(), pkt2.TransportLayer().TransportFlow())
+
+	if key1 == key2 {
+		t.Fatalf("expected distinct source ports to produce distinct flow keys")
+	}
+}
+
+// buildTCPPacketWithPayload is buildTCPPacket plus an application payload,
+// for tests that need the assembler to actually read HTTP request/response
+// bytes off the stream.
+func buildTCPPacketWithPayload(t *testing.T, srcIP, dstIP string, srcPort, dstPort uint16, flags func(*layers.TCP), ts time.Time, payload []byte) gopacket.Packet {
+	t.Helper()
+
+	ip4 := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Id:       1,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(srcIP).To4(),
+		DstIP:    net.ParseIP(dstIP).To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Window:  1024,
+	}
+	if flags != nil {
+		flags(tcp)
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip4); err != nil {
+		t.Fatalf("setting network layer for checksum: %v", err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip4, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("serializing packet: %v", err)
+	}
+
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	pkt.Metadata().Timestamp = ts
+	pkt.Metadata().Length = len(buf.Bytes())
+	return pkt
+}
+
+// TestStreamAssemblerComputesLatencyFromCaptureTime drives a full
+// request/response pair through the real assembler and checks that
+// LatencyMS reflects the gap between their capture timestamps, not
+// wall-clock parse time (which would be ~0 here since the test runs
+// near-instantly, and meaningless for offline pcap replay either way).
+func TestStreamAssemblerComputesLatencyFromCaptureTime(t *testing.T) {
+	a := newStreamAssembler()
+
+	reqTS := time.Unix(1700000000, 0)
+	respTS := reqTS.Add(250 * time.Millisecond)
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test-agent\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n"
+
+	// Each direction opens with SYN so the assembler delivers its data
+	// right away instead of buffering it until a flush.
+	reqPkt := buildTCPPacketWithPayload(t, "10.0.0.1", "10.0.0.2", 54321, httpPort,
+		func(tcp *layers.TCP) { tcp.SYN, tcp.PSH, tcp.ACK = true, true, true }, reqTS, []byte(request))
+	respPkt := buildTCPPacketWithPayload(t, "10.0.0.2", "10.0.0.1", httpPort, 54321,
+		func(tcp *layers.TCP) { tcp.SYN, tcp.PSH, tcp.ACK = true, true, true }, respTS, []byte(response))
+
+	a.AssemblePacket(reqPkt)
+	a.AssemblePacket(respPkt)
+
+	select {
+	case pr := <-a.Packets():
+		if pr.HTTP.Method != "GET" {
+			t.Fatalf("Method = %q, want GET", pr.HTTP.Method)
+		}
+		if pr.HTTP.Hostname != "example.com" {
+			t.Fatalf("Hostname = %q, want example.com", pr.HTTP.Hostname)
+		}
+		if pr.HTTP.UserAgent != "test-agent" {
+			t.Fatalf("UserAgent = %q, want test-agent", pr.HTTP.UserAgent)
+		}
+		if pr.HTTP.StatusCode != 200 {
+			t.Fatalf("StatusCode = %d, want 200", pr.HTTP.StatusCode)
+		}
+		if pr.HTTP.LatencyMS < 240 || pr.HTTP.LatencyMS > 260 {
+			t.Fatalf("LatencyMS = %v, want ~250 (derived from capture timestamps)", pr.HTTP.LatencyMS)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the assembler to emit the HTTP record")
+	}
+}
+
+func TestIsHTTPPacketMatchesEitherDirection(t *testing.T) {
+	toPort80 := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 80, nil, time.Time{})
+	fromPort80 := buildTCPPacket(t, "10.0.0.2", "10.0.0.1", 80, 54321, nil, time.Time{})
+	other := buildTCPPacket(t, "10.0.0.1", "10.0.0.2", 54321, 443, nil, time.Time{})
+
+	if !isHTTPPacket(toPort80) {
+		t.Fatalf("expected a packet destined for port 80 to be treated as HTTP")
+	}
+	if !isHTTPPacket(fromPort80) {
+		t.Fatalf("expected a packet sourced from port 80 to be treated as HTTP")
+	}
+	if isHTTPPacket(other) {
+		t.Fatalf("expected a non-port-80 packet not to be treated as HTTP")
+	}
+}